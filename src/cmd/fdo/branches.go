@@ -2,20 +2,29 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 
+        "cmd/internal/fdo"
         "cmd/internal/objfile"
+        "cmd/internal/perfdata"
 )
 
 var (
 	branchMinimum       = flag.Int("branch_minimum", 100, "minumum branches to create a recommendation")
 	branchLowThreshold  = flag.Float64("branch_low_threshold", 0.10, "success threshold below which recommendations are made")
 	branchHighThreshold = flag.Float64("branch_high_threshold", 0.90, "success threshold for layout optimizations")
+	usePerfScript       = flag.Bool("use-perf-script", false, "shell out to 'perf script' instead of reading perf.data directly")
 )
 
-// branchKey represents a single edge for a branch.
+// branchKey represents a single edge for a branch, identified by the raw
+// program counters involved. This is only meaningful for the lifetime of
+// the binary being analyzed; extractBranches translates it into a
+// fdo.BranchKey (source location, not address) before it is persisted.
 type branchKey struct {
 	source uint64
 	target uint64
@@ -30,18 +39,214 @@ type branchStats struct {
 // brstackRegex matches the format produces by perf script.
 var brstackRegex = regexp.MustCompile("(0x[0-9a-f]+)/(0x[0-9a-f]+)/(M|P|-)/(X|-)/(A|-)/([0-9]+)")
 
-// extractBranches extracts all branch data.
-func extractBranches(exe *objfile.File) error {
-	liner, err := exe.PCLineTable()
+// decodeAt decodes the single instruction at pc, returning its size in
+// bytes and its disassembled text. The size is zero if the instruction
+// could not be decoded.
+func decodeAt(disasm *objfile.Disasm, pc uint64) (size uint64, text string) {
+	// 16 bytes comfortably covers the longest valid instruction on any
+	// architecture we disassemble, so the instruction at pc is always
+	// fully contained in [pc, pc+16).
+	disasm.Decode(pc, pc+16, nil, false, func(p, sz uint64, file string, line int, txt string) {
+		if p == pc && size == 0 {
+			size = sz
+			text = txt
+		}
+	})
+	return
+}
+
+// classifyMnemonic maps a decoded instruction's mnemonic and first operand
+// to an edge kind, without knowing anything about the actual branch
+// target taken at runtime. A conditional jump is always reported as
+// CondTaken; classifyEdge below refines that into CondFallthrough once it
+// knows the recorded target address.
+func classifyMnemonic(mnemonic, operand string) (kind fdo.EdgeKind, ok bool) {
+	// Decode is always called with gnuAsm=false, so operands come out in
+	// Plan9 syntax, not GNU. A direct target is either a raw hex address
+	// ("0x47aeec", taken within the same function) or a symbol made
+	// PC-relative with a trailing "(SB)" ("main.main(SB)"); everything
+	// else is indirect: a bare register ("CX", an interface or closure
+	// call) or a dereferenced memory operand ("0(CX)(SI*8)", a jump
+	// table), neither of which names a fixed destination.
+	indirect := !strings.HasSuffix(operand, "(SB)") &&
+		(strings.Contains(operand, "(") || !strings.HasPrefix(operand, "0x"))
+
+	switch {
+	case mnemonic == "CALL":
+		if indirect {
+			return fdo.Indirect, true
+		}
+		return fdo.Call, true
+	case mnemonic == "RET":
+		return fdo.Return, true
+	case mnemonic == "JMP":
+		if indirect {
+			return fdo.Indirect, true
+		}
+		return fdo.UncondJump, true
+	case strings.HasPrefix(mnemonic, "J"):
+		// Any other J* mnemonic is a conditional jump (JEQ, JNE, JLT,
+		// JGE, JCS, ...).
+		return fdo.CondTaken, true
+	default:
+		return 0, false
+	}
+}
+
+// classifyEdge inspects the instruction at key.source via the disassembly
+// and determines what kind of control-flow edge this branch-stack entry
+// represents. ok is false if the instruction couldn't be decoded, or
+// doesn't look like a branch at all.
+func classifyEdge(disasm *objfile.Disasm, key branchKey) (kind fdo.EdgeKind, ok bool) {
+	size, text := decodeAt(disasm, key.source)
+	if size == 0 {
+		return 0, false
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	mnemonic := fields[0]
+	operand := ""
+	if len(fields) > 1 {
+		operand = fields[1]
+	}
+	kind, ok = classifyMnemonic(mnemonic, operand)
+	if !ok {
+		return 0, false
+	}
+	if kind == fdo.CondTaken && key.target == key.source+size {
+		// The fall-through address is always the next instruction in
+		// program order.
+		return fdo.CondFallthrough, true
+	}
+	return kind, true
+}
+
+// collectBranchStats reads the LBR branch-stack entries recorded in
+// *perfdataFile, aggregating them by (source, target) address pair. By
+// default this parses the perf.data file directly via the perfdata
+// package; passing -use-perf-script falls back to shelling out to
+// `perf script -F brstack` and scraping its output, for systems where
+// the perf.data format this package understands has drifted, or where
+// the in-process parser hits a bug.
+func collectBranchStats(exe *objfile.File) (map[branchKey]*branchStats, error) {
+	if *usePerfScript {
+		return collectBranchStatsViaPerfScript()
+	}
+	return collectBranchStatsViaPerfdata(exe)
+}
+
+// addrRange is a single mmap'd region backing exe, together with the bias
+// between the runtime addresses perf recorded for it and the link-time
+// addresses exe's own symbol table uses.
+type addrRange struct {
+	start, end uint64
+	bias       uint64
+}
+
+// exeRanges finds the mmap regions in mappings that back exe (matched by
+// file name, since perf.data records whatever path the kernel saw, which
+// may take a different form than -binary), together with each region's
+// runtime/link-time bias.
+//
+// exe.LoadAddress is the address exe expects to be loaded at; for a
+// non-PIE binary that's also where the kernel actually puts it, so
+// region.start - region.pgoff - loadAddress is zero and addresses need no
+// translation. For a position-independent binary the kernel picks a
+// different (randomized) address at run time, and that difference is
+// exactly the bias to undo before looking an address up in exe.
+func exeRanges(exe *objfile.File, mappings []perfdata.Mapping) ([]addrRange, error) {
+	loadAddress, err := exe.LoadAddress()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	disasm, err := exe.Disasm()
+	name := filepath.Base(*binary)
+	var ranges []addrRange
+	for _, m := range mappings {
+		if filepath.Base(m.Filename) != name {
+			continue
+		}
+		ranges = append(ranges, addrRange{
+			start: m.Start,
+			end:   m.Start + m.Len,
+			bias:  m.Start - m.PgOff - loadAddress,
+		})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("fdo: no mmap of %q found in %s", *binary, *perfdataFile)
+	}
+	return ranges, nil
+}
+
+// staticAddr translates a runtime address into the link-time address
+// exe's symbol table uses, or reports ok=false if addr isn't inside any of
+// ranges at all (e.g. it belongs to some other mapped library, or the
+// kernel).
+func staticAddr(ranges []addrRange, addr uint64) (_ uint64, ok bool) {
+	for _, r := range ranges {
+		if addr >= r.start && addr < r.end {
+			return addr - r.bias, true
+		}
+	}
+	return 0, false
+}
+
+// collectBranchStatsViaPerfdata parses *perfdataFile directly, without
+// invoking the external perf tool. Only branches with both ends inside a
+// mapping of exe are kept, translated from the runtime addresses perf
+// recorded to the link-time addresses exe's symbol table and disassembly
+// use.
+func collectBranchStatsViaPerfdata(exe *objfile.File) (map[branchKey]*branchStats, error) {
+	r, err := perfdata.Open(*perfdataFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer r.Close()
+
+	mappings, err := r.Mappings()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := exeRanges(exe, mappings)
+	if err != nil {
+		return nil, err
 	}
 
-	// Extract all perf data with respect to branches.
+	bi := make(map[branchKey]*branchStats)
+	err = r.Branches(func(from, to uint64, predicted, mispred bool, cycles uint16) {
+		if from > userTop || to > userTop {
+			return // Skip kernel addresses.
+		}
+		from, ok := staticAddr(ranges, from)
+		if !ok {
+			return // Not inside exe; e.g. a jump into some other library.
+		}
+		to, ok = staticAddr(ranges, to)
+		if !ok {
+			return
+		}
+		key := branchKey{source: from, target: to}
+		stats, ok := bi[key]
+		if !ok {
+			stats = new(branchStats)
+			bi[key] = stats
+		}
+		if predicted {
+			stats.predicted++
+		} else if mispred {
+			stats.missed++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+// collectBranchStatsViaPerfScript is the original implementation, kept as
+// a fallback behind -use-perf-script.
+func collectBranchStatsViaPerfScript() (map[branchKey]*branchStats, error) {
 	bi := make(map[branchKey]*branchStats)
 	if err := runPerfScript(brstackRegex, "brstack", func(parts []string) {
 		// Extract the source and target.
@@ -73,104 +278,182 @@ func extractBranches(exe *objfile.File) error {
 			stats.missed++
 		}
 	}); err != nil {
-		return err
+		return nil, err
 	}
+	return bi, nil
+}
 
-	// Extract aggregrate information.
-	totals := make(map[branchKey]int)
-	hits := make(map[branchKey]float64)
+// extractBranches parses LBR branch-stack data for exe and aggregates it
+// into a fdo.Profile, keyed by source location rather than by address.
+func extractBranches(exe *objfile.File) (*fdo.Profile, error) {
+	liner, err := exe.PCLineTable()
+	if err != nil {
+		return nil, err
+	}
+	disasm, err := exe.Disasm()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract all perf data with respect to branches.
+	bi, err := collectBranchStats(exe)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dump out the most-hit raw edges, purely for operator visibility;
+	// none of this is persisted.
 	sortedByTotal := make([]branchKey, 0, len(bi))
-	sortedByHit := make([]branchKey, 0, len(bi))
 	for key, stats := range bi {
-		total := stats.predicted + stats.missed
-		if total < *branchMinimum {
-			continue // Not interesting.
+		if stats.predicted+stats.missed < *branchMinimum {
+			continue
 		}
-		hit := float64(stats.predicted)/float64(total)
-		if hit > *branchLowThreshold && hit < *branchHighThreshold {
-			continue // Not interesting.
-		}
-		totals[key] = total
-		hits[key] = float64(stats.predicted)/float64(total)
 		sortedByTotal = append(sortedByTotal, key)
-		sortedByHit = append(sortedByHit, key)
 	}
-	sort.Slice(sortedByTotal, func(i, j int) bool { return totals[sortedByTotal[i]] > totals[sortedByTotal[j]] })
-	sort.Slice(sortedByHit, func(i, j int) bool { return hits[sortedByHit[i]] < hits[sortedByHit[j]] })
+	sort.Slice(sortedByTotal, func(i, j int) bool {
+		a, b := bi[sortedByTotal[i]], bi[sortedByTotal[j]]
+		return a.predicted+a.missed > b.predicted+b.missed
+	})
+	if len(sortedByTotal) > 0 {
+		debug("Most hit branches:")
+		for _, key := range sortedByTotal {
+			stats := bi[key]
+			total := stats.predicted + stats.missed
+			debug("  0x%x->0x%x: %d (%2.2f)", key.source, key.target, total, float64(stats.predicted)/float64(total))
+		}
+	}
 
-	// Do we produce anything at all?
-	if len(sortedByTotal) == 0 {
-		return nil
+	// Symbolize and classify every branch that cleared branchMinimum,
+	// and aggregate it into the profile by (file, line, func, kind)
+	// rather than by address, so the profile stays valid across
+	// rebuilds that change the binary's layout.
+	profile := fdo.NewProfile()
+	for _, key := range sortedByTotal {
+		filename, line, fn := liner.PCToLine(key.source)
+		if fn == nil || filename == "" || line <= 0 {
+			continue // No source location to attribute this to.
+		}
+		kind, ok := classifyEdge(disasm, key)
+		if !ok {
+			continue // Not a recognizable branch instruction.
+		}
+		stats := bi[key]
+		profile.Add(fdo.BranchKey{File: filename, Line: line, Func: fn.Name, Kind: kind},
+			uint64(stats.predicted), uint64(stats.missed))
 	}
 
-	// Dump out top results.
-	printBranch := func(key branchKey) {
-		debug("  0x%x->0x%x: %d (%2.2f)", key.source, key.target, totals[key], hits[key])
+	// Use the same LBR edge weights to recommend a whole-function basic
+	// block layout, not just per-branch likely/unlikely hints.
+	layouts, err := buildLayouts(exe, disasm, bi)
+	if err != nil {
+		return nil, err
 	}
-	debug("Most hit branches:")
-	for _, key := range sortedByTotal {
-		printBranch(key)
+	for _, l := range layouts {
+		profile.AddLayout(l)
 	}
-	debug("Worst & best predicted branches:")
-	for _, key := range sortedByHit {
-		printBranch(key)
+	if len(layouts) > 0 {
+		debug("Block layout recommendations:")
+		for _, l := range layouts {
+			debug("  %s: %v", l.Func, l.BlockOrder)
+		}
 	}
 
-	// If the source for this file indicates that the correctly predicted
-	// branch target is a jump instruction, then we can improve performance
-	// by optimizing in the appropriate directly. This tests if the given
-	// branch is a jump by seeing if the target is the next contiguous
-	// instruction.
-	isJump := func(key branchKey) (jump bool) {
-		// FIXME: as a heuristic, we just check if the target follows
-		// within 16 bytes of the source. In the future, we should use
-		// the objfile disassembly itself for this check.
-		_ = disasm
-		return key.target > key.source && key.target <= key.source+16
-	}
+	return profile, nil
+}
 
-	candidates := make(map[branchKey]bool)
-	for _, key := range sortedByTotal {
-		if hits[key] < *branchLowThreshold && isJump(key) {
+// candidates returns the branches in p that look like good candidates for
+// layout optimization: calls, returns, and indirect edges are never
+// candidates, since there's no single preferred target to lay out towards.
+func candidates(p *fdo.Profile) []fdo.BranchKey {
+	var keys []fdo.BranchKey
+	for key, c := range p.Branches {
+		switch key.Kind {
+		case fdo.Call, fdo.Return, fdo.Indirect:
+			continue
+		}
+		total := c.Total()
+		if total == 0 {
+			continue
+		}
+		hit := float64(c.Predicted) / float64(total)
+		taken := key.Kind == fdo.UncondJump || key.Kind == fdo.CondTaken
+		if hit < *branchLowThreshold && taken {
 			// We're not taking the jump when we should be. This
 			// suggests that we should lay out the code as in the
 			// "likely" case.
-			candidates[key] = true
-		} else if hits[key] < *branchLowThreshold && !isJump(key) {
+			keys = append(keys, key)
+		} else if hit < *branchLowThreshold && !taken {
 			// We are taking the jump when we should be? This is
 			// strange, as without a prediction the CPU should
 			// continue execution in a straight line. Presumably
 			// this might be some kind of clash on the predictor
 			// lines, so we shouldn't recommend anything.
-		} else if hits[key] > *branchHighThreshold && isJump(key) {
+		} else if hit > *branchHighThreshold && taken {
 			// The predictor is getting it right here, but it is
 			// laid out as a jump. This has the effect of producing
 			// slower code than a contiguous code block. We can
 			// mark this as likely as well.
-			candidates[key] = true
+			keys = append(keys, key)
 		}
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Func < b.Func
+	})
+	return keys
+}
 
-	// Dump out all candidates.
-	if len(candidates) > 0 {
-		debug("Optimization candidates:")
+// applyBranches prints the layout-optimization candidates found in p. No
+// compiler in this tree consumes these; this is a preview of what a
+// consumer would act on (see the SCOPE NOTE in cmd/internal/fdo/hints.go).
+func applyBranches(p *fdo.Profile) error {
+	keys := candidates(p)
+	if len(keys) == 0 {
+		return nil
 	}
-	for key := range candidates {
-		filename, line, fn := liner.PCToLine(key.source)
-		printBranch(key) // Show raw information.
-		if fn != nil && filename != "" && line > 0 {
-			debug("  %s:%d (%2.2f)", filename, line, hits[key])
-		}
+	debug("Optimization candidates:")
+	for _, key := range keys {
+		c := p.Branches[key]
+		hit := float64(c.Predicted) / float64(c.Total())
+		debug("  %s:%d %s() [%s] (%2.2f)", key.File, key.Line, key.Func, key.Kind, hit)
 	}
-
 	return nil
 }
 
-// applyBranches applies branch feedback data.
-func applyBranches(exe *objfile.File) error {
-	if err := extractBranches(exe); err != nil {
-		return err
+// applyLayouts prints the block layout recommendations recorded in p.
+func applyLayouts(p *fdo.Profile) error {
+	if len(p.Layouts) == 0 {
+		return nil
 	}
+	names := make([]string, 0, len(p.Layouts))
+	for name := range p.Layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	debug("Block layout recommendations:")
+	for _, name := range names {
+		l := p.Layouts[name]
+		debug("  %s: %v", l.Func, l.BlockOrder)
+	}
+	return nil
+}
 
-	return nil // All done.
+// printHints prints the fdo.BranchHint records that a compiler would load
+// from p via -fdoprofile, were one wired up to consume them; see the SCOPE
+// NOTE in cmd/internal/fdo/hints.go for why that wiring isn't in this tree.
+func printHints(p *fdo.Profile) {
+	hints := p.Hints(*branchLowThreshold, *branchHighThreshold)
+	if len(hints) == 0 {
+		return
+	}
+	debug("Branch hints:")
+	for _, h := range hints {
+		debug("  %s:%d %s() likely=%2.2f", h.File, h.Line, h.Func, h.Probability)
+	}
 }
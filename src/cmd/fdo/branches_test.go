@@ -0,0 +1,42 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"cmd/internal/fdo"
+)
+
+func TestClassifyMnemonic(t *testing.T) {
+	cases := []struct {
+		mnemonic, operand string
+		wantKind          fdo.EdgeKind
+		wantOK            bool
+	}{
+		// Direct targets: a raw hex address within the function, or a
+		// symbol made PC-relative with "(SB)".
+		{"CALL", "main.Sq.Area(SB)", fdo.Call, true},
+		{"JMP", "0x47aeec", fdo.UncondJump, true},
+		{"JMP", "main.main(SB)", fdo.UncondJump, true},
+		{"JEQ", "0x47aeec", fdo.CondTaken, true},
+
+		// Indirect targets: a bare register, or a dereferenced memory
+		// operand, neither of which names a fixed destination.
+		{"CALL", "CX", fdo.Indirect, true},
+		{"JMP", "AX", fdo.Indirect, true},
+		{"JMP", "0(CX)(SI*8)", fdo.Indirect, true},
+
+		{"RET", "", fdo.Return, true},
+		{"MOVQ", "SP, BP", 0, false},
+	}
+	for _, c := range cases {
+		kind, ok := classifyMnemonic(c.mnemonic, c.operand)
+		if ok != c.wantOK || (ok && kind != c.wantKind) {
+			t.Errorf("classifyMnemonic(%q, %q) = (%v, %v), want (%v, %v)",
+				c.mnemonic, c.operand, kind, ok, c.wantKind, c.wantOK)
+		}
+	}
+}
@@ -6,11 +6,31 @@
 FDO is a program for recording perf profiles, extracting performance data, and
 applying feedback-directed optimization.
 
-First, a profile must be generated for the binary. This can be done via `go
-tool fdo -record ...` or manually with the perf tool. The tool will use binary
-debug information and store only feedback to inform optimizations.
+First, raw performance data must be recorded for the binary. This can be
+done via `go tool fdo -record ...` or manually with the perf tool.
 
-Next, the optimizations can be applied via `go tool fdo -apply`.
+Next, `go tool fdo -extract` symbolizes that data against the binary's
+debug information and writes a portable fdo profile, keyed by source
+location rather than by address so that it survives rebuilds. Profiles
+recorded across a distributed workload can be combined with `go tool fdo
+-merge`.
+
+By default, -extract reads perf.data directly, without invoking the perf
+tool at all, so it works even on a machine where perf isn't installed;
+pass -use-perf-script to fall back to the old behavior of shelling out to
+`perf script -F brstack` instead.
+
+Finally, the optimizations can be applied via `go tool fdo -apply`, which
+reads the fdo profile directly and does not need the binary at all.
+`go tool fdo -apply -hints` prints the fdo.BranchHint records that a
+compiler could derive from a profile to bias block layout and spill
+placement toward the hot edge of each branch; `go tool fdo -apply
+-layout` prints the recommended basic-block ordering for each function
+with enough LBR traffic to be worth reordering, derived from the same
+edge weights by a greedy Pettis-Hansen-style chain formation followed by
+a bounded ext-TSP local search. Neither is wired into a compiler yet:
+cmd/internal/fdo only defines the profile format and these derived views
+of it, as a stable foundation for a future compiler flag to read.
 
 For usage information, please see:
 	go tool fdo -help
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"syscall"
 
+	"cmd/internal/fdo"
 	"cmd/internal/objfile"
 )
 
@@ -26,15 +27,32 @@ Record a profile using the perf tool:
 
 A profile can also be recorded manually with the perf tool.
 
-Apply branch intrinsics:
-	go tool fdo -apply -perfdata=data -binary=bin -branches
+Extract a portable fdo profile from the recorded data, symbolized against
+the binary that was run:
+	go tool fdo -extract -perfdata=data -binary=bin -profile=fdo.profile
+
+Profiles recorded on multiple machines (or across multiple runs) can be
+combined before use:
+	go tool fdo -merge -profile=fdo.profile a.profile b.profile ...
+
+Apply branch intrinsics from an extracted profile:
+	go tool fdo -apply -profile=fdo.profile -branches
+
+Print the recommended basic-block layout for each hot function:
+	go tool fdo -apply -profile=fdo.profile -layout
+
+Print the fdo.BranchHint records a compiler could derive from the
+profile to bias block layout and spill placement (no compiler reads
+these yet; this is a preview of the data cmd/internal/fdo exposes):
+	go tool fdo -apply -profile=fdo.profile -hints
 `
 
 func usage() {
-	fmt.Fprintln(os.Stderr, usageMessage)
+	// usageMessage already ends in a newline.
+	fmt.Fprint(os.Stderr, usageMessage)
 	fmt.Fprintln(os.Stderr, "Flags:")
 	flag.PrintDefaults()
-	fmt.Fprintln(os.Stderr, "\n  Exactly one of -record, or -apply must be set.")
+	fmt.Fprintln(os.Stderr, "\n  Exactly one of -record, -extract, -merge, or -apply must be set.")
 	os.Exit(2)
 }
 
@@ -43,11 +61,16 @@ func debug(format string, args... interface{}) {
 }
 
 var (
-	record   = flag.Bool("record", false, "record performance data")
-	apply    = flag.Bool("apply", false, "apply feedback-directed optimizations")
-	perfdata = flag.String("perfdata", "perf.data", "performance data file for input/output")
-	binary   = flag.String("binary", "", "binary for symbolization")
-	branches = flag.Bool("branches", false, "apply branch intrinsics")
+	record       = flag.Bool("record", false, "record performance data")
+	extract      = flag.Bool("extract", false, "extract a portable fdo profile from performance data")
+	merge        = flag.Bool("merge", false, "merge multiple fdo profiles")
+	apply        = flag.Bool("apply", false, "apply feedback-directed optimizations from a profile")
+	perfdataFile = flag.String("perfdata", "perf.data", "performance data file for input")
+	binary       = flag.String("binary", "", "binary for symbolization")
+	profile      = flag.String("profile", "fdo.profile", "fdo profile file for input/output")
+	branches     = flag.Bool("branches", false, "apply branch intrinsics")
+	hints        = flag.Bool("hints", false, "print the fdo.BranchHint records the compiler would load via -fdoprofile")
+	layout       = flag.Bool("layout", false, "print block layout recommendations")
 )
 
 const (
@@ -63,28 +86,40 @@ func main() {
 		flag.Usage()
 	}
 
-	// At least one mode is required.
-	if (!*record && !*apply) || (*record && *apply) {
-		fmt.Fprintf(os.Stderr, `Exactly one of -record, or -apply must be set.`)
+	// Exactly one mode is required.
+	modes := 0
+	for _, set := range []bool{*record, *extract, *merge, *apply} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		fmt.Fprintf(os.Stderr, "Exactly one of -record, -extract, -merge, or -apply must be set.\n")
 		fmt.Fprintln(os.Stderr, `For usage information, run "go tool fdo -help"`)
 		os.Exit(2)
 	} else if *record && flag.NArg() == 0 {
 		flag.Usage()
-	} else if *apply && flag.NArg() != 0 {
+	} else if *merge && flag.NArg() == 0 {
+		flag.Usage()
+	} else if (*extract || *apply) && flag.NArg() != 0 {
 		flag.Usage()
 	}
 
 	// Run the appropriate mode.
-	if *record {
-		if err := recordPerf(flag.Args()); err != nil {
-			fmt.Fprintf(os.Stderr, "fdo record: %v\n", err)
-			os.Exit(2)
-		}
-	} else {
-		if err := applyPerf(); err != nil {
-			fmt.Fprintf(os.Stderr, "fdo apply: %v\n", err)
-			os.Exit(2)
-		}
+	var err error
+	switch {
+	case *record:
+		err = recordPerf(flag.Args())
+	case *extract:
+		err = extractPerf()
+	case *merge:
+		err = mergePerf(flag.Args())
+	case *apply:
+		err = applyPerf()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fdo: %v\n", err)
+		os.Exit(2)
 	}
 }
 
@@ -113,7 +148,7 @@ func runPerfScript(matcher *regexp.Regexp, field string, fn func([]string)) erro
 	cmd := exec.Command(
 		"perf", "script",
 		"-F", field,
-		"-i", *perfdata,
+		"-i", *perfdataFile,
 	)
 	cmd.Stderr = os.Stderr // Pass through error output.
 
@@ -170,20 +205,88 @@ func runPerfScript(matcher *regexp.Regexp, field string, fn func([]string)) erro
 	return nil
 }
 
-// applyPerf applies the given perf profile in the current directory.
-//
-// This uses the perf tool to extract relevant data from the perf data, and
-// applies relevant intrinsics to the AST.
-func applyPerf() error {
-	// Open the main binary.
+// extractPerf symbolizes the recorded performance data against the given
+// binary and writes a portable fdo profile to disk. This needs the binary,
+// but whatever machine later applies the profile does not: the resulting
+// file is keyed by source location, not by address, so it survives
+// rebuilds with a different code layout.
+func extractPerf() error {
 	exe, err := objfile.Open(*binary)
 	if err != nil {
 		return err
 	}
 
-	// Start applying optimizations.
+	p, err := extractBranches(exe)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*profile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.Write(f)
+}
+
+// mergePerf sums the counters in the named fdo profiles and writes the
+// result to *profile, so that data recorded across a distributed workload
+// can be combined before being applied.
+func mergePerf(names []string) error {
+	profiles := make([]*fdo.Profile, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		p, err := fdo.Read(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		profiles = append(profiles, p)
+	}
+
+	merged := fdo.Merge(profiles...)
+	f, err := os.Create(*profile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return merged.Write(f)
+}
+
+// applyPerf prints the optimization recommendations derived from the fdo
+// profile at *profile: branch-layout candidates (-branches), compiler-facing
+// branch hints (-hints), and basic-block layout (-layout). None of these are
+// applied to a compiler in this tree (see the SCOPE NOTE in
+// cmd/internal/fdo/hints.go); -apply only surfaces what a consumer would act
+// on. Unlike -extract, this does not need the binary at all: the profile is
+// already keyed by source location.
+func applyPerf() error {
+	f, err := os.Open(*profile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, err := fdo.Read(f)
+	if err != nil {
+		return err
+	}
+
 	if *branches {
-		if err := applyBranches(exe); err != nil {
+		if err := applyBranches(p); err != nil {
+			return err
+		}
+	}
+
+	if *hints {
+		printHints(p)
+	}
+
+	if *layout {
+		if err := applyLayouts(p); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+
+        "cmd/internal/fdo"
+        "cmd/internal/objfile"
+)
+
+var (
+	layoutMinimum  = flag.Int("layout_minimum", 100, "minimum weight of a function's hottest edge for its blocks to be reordered")
+	layoutLocalOpt = flag.Bool("layout_local_search", true, "run a local-search pass to improve the ext-TSP score of the chosen layout")
+)
+
+// instrInfo is everything buildBlocks needs to know about one decoded
+// instruction in order to find basic-block boundaries.
+type instrInfo struct {
+	pc, size  uint64
+	kind      fdo.EdgeKind
+	isBranch  bool
+	target    uint64
+	hasTarget bool
+}
+
+// decodeFunction decodes every instruction in [start, end), in address
+// order.
+func decodeFunction(disasm *objfile.Disasm, start, end uint64) []instrInfo {
+	var instrs []instrInfo
+	disasm.Decode(start, end, nil, false, func(pc, size uint64, file string, line int, text string) {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			instrs = append(instrs, instrInfo{pc: pc, size: size})
+			return
+		}
+		mnemonic := fields[0]
+		operand := ""
+		if len(fields) > 1 {
+			operand = fields[1]
+		}
+		kind, ok := classifyMnemonic(mnemonic, operand)
+		in := instrInfo{pc: pc, size: size}
+		if ok {
+			in.kind = kind
+			in.isBranch = true
+			if t, tok := directTarget(operand); tok {
+				in.target = t
+				in.hasTarget = true
+			}
+		}
+		instrs = append(instrs, in)
+	})
+	return instrs
+}
+
+// directTarget parses a direct-jump operand like "0x4512a0" into its
+// address. It returns false for indirect operands (registers, memory).
+func directTarget(operand string) (uint64, bool) {
+	if !strings.HasPrefix(operand, "0x") {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(operand[2:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// block is a basic block within a single function, identified by its
+// index in original program order (block 0 is always the entry block).
+type block struct {
+	start, end uint64
+}
+
+// buildBlocks splits [start, end) into basic blocks using the standard
+// leaders construction: the function entry, the instruction after every
+// branch/return, and the target of every resolvable direct jump are all
+// block leaders. Calls aren't treated as block boundaries, since control
+// always returns to the following instruction.
+func buildBlocks(disasm *objfile.Disasm, start, end uint64) ([]block, []instrInfo) {
+	instrs := decodeFunction(disasm, start, end)
+	if len(instrs) == 0 {
+		return nil, nil
+	}
+
+	leaders := map[uint64]bool{start: true}
+	for _, in := range instrs {
+		if !in.isBranch || in.kind == fdo.Call {
+			continue
+		}
+		next := in.pc + in.size
+		if next < end {
+			leaders[next] = true
+		}
+		if in.kind != fdo.Return && in.hasTarget && in.target >= start && in.target < end {
+			leaders[in.target] = true
+		}
+	}
+
+	sorted := make([]uint64, 0, len(leaders))
+	for l := range leaders {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	blocks := make([]block, 0, len(sorted))
+	for i, l := range sorted {
+		next := end
+		if i+1 < len(sorted) {
+			next = sorted[i+1]
+		}
+		blocks = append(blocks, block{start: l, end: next})
+	}
+	return blocks, instrs
+}
+
+// weightedEdge is a directed edge between two blocks (by index) in a
+// function's CFG, weighted by observed LBR traffic.
+type weightedEdge struct {
+	from, to int
+	weight   uint64
+}
+
+// functionEdges builds the structural CFG for the blocks of a function,
+// and weighs each edge using bi, the raw (source pc, target pc) -> stats
+// map collected from the LBR data.
+func functionEdges(blocks []block, instrs []instrInfo, bi map[branchKey]*branchStats) []weightedEdge {
+	addrToBlock := make(map[uint64]int, len(blocks))
+	for i, b := range blocks {
+		addrToBlock[b.start] = i
+	}
+	instrByEnd := make(map[uint64]instrInfo, len(instrs))
+	for _, in := range instrs {
+		instrByEnd[in.pc+in.size] = in
+	}
+
+	weight := func(source, target uint64) uint64 {
+		if stats, ok := bi[branchKey{source: source, target: target}]; ok {
+			return uint64(stats.predicted + stats.missed)
+		}
+		return 0
+	}
+
+	var edges []weightedEdge
+	for i, b := range blocks {
+		term, ok := instrByEnd[b.end]
+		if !ok || !term.isBranch {
+			// Falls straight through to the next block in address
+			// order; there's no separate instruction to look up a
+			// recorded edge for.
+			if i+1 < len(blocks) {
+				edges = append(edges, weightedEdge{from: i, to: i + 1})
+			}
+			continue
+		}
+		switch term.kind {
+		case fdo.Return, fdo.Indirect:
+			// No statically-known intraprocedural successor.
+		case fdo.Call:
+			// Calls don't end blocks (see buildBlocks), so term is
+			// only a Call here if some other leader happens to land
+			// right after one; control still falls straight through.
+			if i+1 < len(blocks) {
+				edges = append(edges, weightedEdge{from: i, to: i + 1})
+			}
+		case fdo.UncondJump:
+			if term.hasTarget {
+				if to, ok := addrToBlock[term.target]; ok {
+					edges = append(edges, weightedEdge{from: i, to: to, weight: weight(term.pc, term.target)})
+				}
+			}
+		default: // CondTaken/CondFallthrough (classifyMnemonic never
+			// distinguishes them; either way this is a conditional
+			// branch with two successors).
+			if i+1 < len(blocks) {
+				edges = append(edges, weightedEdge{from: i, to: i + 1, weight: weight(term.pc, blocks[i+1].start)})
+			}
+			if term.hasTarget {
+				if to, ok := addrToBlock[term.target]; ok {
+					edges = append(edges, weightedEdge{from: i, to: to, weight: weight(term.pc, term.target)})
+				}
+			}
+		}
+	}
+	return edges
+}
+
+// chainLayout runs a greedy Pettis-Hansen-style chain formation over the
+// weighted edges of an n-block CFG: each block starts in its own chain,
+// and the highest-weight edge whose source is a chain tail and whose
+// destination is a different chain's head merges those two chains. Ties
+// break by edge weight, then by (from, to) in original program order.
+// Blocks with no incoming hot edge simply never get merged into anyone
+// else's chain.
+func chainLayout(n int, edges []weightedEdge) []int {
+	if n == 0 {
+		return nil
+	}
+
+	sorted := make([]weightedEdge, len(edges))
+	copy(sorted, edges)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		if a.from != b.from {
+			return a.from < b.from
+		}
+		return a.to < b.to
+	})
+
+	type chain struct {
+		blocks []int
+		head   int
+		tail   int
+	}
+	chains := make([]*chain, n)
+	owner := make([]*chain, n) // which chain currently contains block i
+	for i := 0; i < n; i++ {
+		c := &chain{blocks: []int{i}, head: i, tail: i}
+		chains[i] = c
+		owner[i] = c
+	}
+
+	for _, e := range sorted {
+		if e.weight == 0 {
+			continue // No observed traffic; nothing to act on.
+		}
+		cu, cv := owner[e.from], owner[e.to]
+		if cu == cv || cu.tail != e.from || cv.head != e.to {
+			continue // Not a tail->head join between distinct chains.
+		}
+		cu.blocks = append(cu.blocks, cv.blocks...)
+		cu.tail = cv.tail
+		for _, b := range cv.blocks {
+			owner[b] = cu
+		}
+	}
+
+	seen := make(map[*chain]bool, n)
+	var unique []*chain
+	for i := 0; i < n; i++ {
+		c := owner[i]
+		if !seen[c] {
+			seen[c] = true
+			unique = append(unique, c)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].head < unique[j].head })
+
+	order := make([]int, 0, n)
+	for _, c := range unique {
+		order = append(order, c.blocks...)
+	}
+	return order
+}
+
+// extTSPScore computes the extended-TSP objective for a candidate block
+// order: the sum, over every weighted edge, of w(u,v)*f(dist(u,v)), where
+// f is 1 for a true fall-through, 0.1 for a short forward jump within
+// 1KiB, and 0 otherwise.
+func extTSPScore(order []int, sizes []uint64, edges []weightedEdge) float64 {
+	pos := make([]uint64, len(order))
+	offset := uint64(0)
+	for _, b := range order {
+		pos[b] = offset
+		offset += sizes[b]
+	}
+	var score float64
+	for _, e := range edges {
+		if e.weight == 0 {
+			continue
+		}
+		d := int64(pos[e.to]) - int64(pos[e.from]) - int64(sizes[e.from])
+		var f float64
+		switch {
+		case d == 0:
+			f = 1
+		case d > 0 && d <= 1024:
+			f = 0.1
+		}
+		score += float64(e.weight) * f
+	}
+	return score
+}
+
+// localSearch tries a small number of passes of swaps of adjacent blocks
+// in order, keeping any swap that improves the ext-TSP score.
+// This is deliberately bounded: it's meant to clean up the occasional bad
+// call made by the greedy chain formation above, not to re-derive the
+// layout from scratch.
+func localSearch(order []int, sizes []uint64, edges []weightedEdge) []int {
+	best := append([]int(nil), order...)
+	bestScore := extTSPScore(best, sizes, edges)
+	const passes = 3
+	for pass := 0; pass < passes; pass++ {
+		improved := false
+		for i := 0; i+1 < len(best); i++ {
+			trial := append([]int(nil), best...)
+			trial[i], trial[i+1] = trial[i+1], trial[i]
+			if s := extTSPScore(trial, sizes, edges); s > bestScore {
+				best, bestScore = trial, s
+				improved = true
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return best
+}
+
+// layoutFunction derives a FunctionLayout recommendation for the function
+// symbol sym, or reports ok=false if there isn't enough data to say
+// anything useful (fewer than two blocks, or no edge weighing at least
+// -layout_minimum).
+func layoutFunction(disasm *objfile.Disasm, sym objfile.Sym, bi map[branchKey]*branchStats) (fdo.FunctionLayout, bool) {
+	start, end := sym.Addr, sym.Addr+uint64(sym.Size)
+	blocks, instrs := buildBlocks(disasm, start, end)
+	if len(blocks) < 2 {
+		return fdo.FunctionLayout{}, false
+	}
+	edges := functionEdges(blocks, instrs, bi)
+
+	hot := false
+	for _, e := range edges {
+		if e.weight >= uint64(*layoutMinimum) {
+			hot = true
+			break
+		}
+	}
+	if !hot {
+		return fdo.FunctionLayout{}, false
+	}
+
+	order := chainLayout(len(blocks), edges)
+	if *layoutLocalOpt {
+		sizes := make([]uint64, len(blocks))
+		for i, b := range blocks {
+			sizes[i] = b.end - b.start
+		}
+		order = localSearch(order, sizes, edges)
+	}
+	return fdo.FunctionLayout{Func: sym.Name, BlockOrder: order}, true
+}
+
+// buildLayouts derives a FunctionLayout recommendation for every function
+// symbol in exe with enough LBR traffic to be worth reordering.
+func buildLayouts(exe *objfile.File, disasm *objfile.Disasm, bi map[branchKey]*branchStats) ([]fdo.FunctionLayout, error) {
+	syms, err := exe.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	var layouts []fdo.FunctionLayout
+	for _, sym := range syms {
+		if sym.Code != 'T' && sym.Code != 't' || sym.Size <= 0 {
+			continue // Not a function symbol.
+		}
+		if l, ok := layoutFunction(disasm, sym, bi); ok {
+			layouts = append(layouts, l)
+		}
+	}
+	return layouts, nil
+}
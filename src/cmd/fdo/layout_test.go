@@ -0,0 +1,175 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cmd/internal/fdo"
+)
+
+// linearBlocks returns n blocks of size 1 each, laid out back to back
+// starting at 0 — enough structure for chainLayout/extTSPScore/localSearch,
+// which only care about block indices and sizes, not real code.
+func linearBlocks(n int) []uint64 {
+	sizes := make([]uint64, n)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	return sizes
+}
+
+func TestChainLayoutMergesHotEdges(t *testing.T) {
+	// 0 -> 1 is hot, 0 -> 2 is cold and is 2's only incoming edge.
+	// Chain formation should pull 1 right after 0, and leave 2 on its own.
+	edges := []weightedEdge{
+		{from: 0, to: 1, weight: 100},
+		{from: 0, to: 2, weight: 1},
+	}
+	order := chainLayout(3, edges)
+	if len(order) != 3 {
+		t.Fatalf("chainLayout returned %d blocks, want 3", len(order))
+	}
+	posOf := make(map[int]int, 3)
+	for i, b := range order {
+		posOf[b] = i
+	}
+	if posOf[1] != posOf[0]+1 {
+		t.Errorf("chainLayout(%v) = %v, want block 1 immediately after block 0", edges, order)
+	}
+}
+
+func TestChainLayoutIgnoresZeroWeightEdges(t *testing.T) {
+	// With no observed traffic at all, chains never merge: original
+	// program order is preserved.
+	edges := []weightedEdge{{from: 0, to: 1, weight: 0}}
+	if got, want := chainLayout(2, edges), []int{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chainLayout with only zero-weight edges = %v, want %v", got, want)
+	}
+}
+
+func TestChainLayoutEmpty(t *testing.T) {
+	if got := chainLayout(0, nil); got != nil {
+		t.Errorf("chainLayout(0, nil) = %v, want nil", got)
+	}
+}
+
+func TestExtTSPScoreFallthroughBeatsJump(t *testing.T) {
+	sizes := linearBlocks(3)
+	edges := []weightedEdge{{from: 0, to: 1, weight: 10}}
+
+	fallthrough_ := extTSPScore([]int{0, 1, 2}, sizes, edges)
+	jump := extTSPScore([]int{0, 2, 1}, sizes, edges)
+	if fallthrough_ <= jump {
+		t.Errorf("extTSPScore(fallthrough order) = %v, want > extTSPScore(non-adjacent order) = %v", fallthrough_, jump)
+	}
+}
+
+func TestExtTSPScoreIgnoresZeroWeightEdges(t *testing.T) {
+	sizes := linearBlocks(2)
+	edges := []weightedEdge{{from: 0, to: 1, weight: 0}}
+	if got := extTSPScore([]int{0, 1}, sizes, edges); got != 0 {
+		t.Errorf("extTSPScore with a zero-weight edge = %v, want 0", got)
+	}
+}
+
+func TestLocalSearchFixesABadChainOrder(t *testing.T) {
+	sizes := linearBlocks(3)
+	edges := []weightedEdge{{from: 1, to: 2, weight: 10}}
+
+	// Chain formation (or any other source) produced an order with 1 and
+	// 2 not adjacent; local search should swap them back next to each
+	// other, since that's a strict ext-TSP improvement one swap away.
+	start := []int{1, 0, 2}
+	got := localSearch(start, sizes, edges)
+
+	startScore := extTSPScore(start, sizes, edges)
+	gotScore := extTSPScore(got, sizes, edges)
+	if gotScore < startScore {
+		t.Fatalf("localSearch(%v) = %v (score %v), regressed from score %v", start, got, gotScore, startScore)
+	}
+	if gotScore == startScore {
+		t.Errorf("localSearch(%v) = %v, found no improving swap though one exists", start, got)
+	}
+}
+
+func TestLocalSearchNeverRegresses(t *testing.T) {
+	sizes := linearBlocks(4)
+	edges := []weightedEdge{
+		{from: 0, to: 1, weight: 5},
+		{from: 2, to: 3, weight: 9},
+	}
+	for _, start := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 0, 3, 2}} {
+		got := localSearch(append([]int(nil), start...), sizes, edges)
+		if extTSPScore(got, sizes, edges) < extTSPScore(start, sizes, edges) {
+			t.Errorf("localSearch(%v) = %v, regressed the ext-TSP score", start, got)
+		}
+	}
+}
+
+func TestFunctionEdgesFallthroughAndConditional(t *testing.T) {
+	// Three blocks: block 0 ends in a conditional branch to block 2
+	// (block 1 is the fall-through); block 1 falls straight through to
+	// block 2; block 2 ends in a return.
+	blocks := []block{
+		{start: 0, end: 10},
+		{start: 10, end: 20},
+		{start: 20, end: 30},
+	}
+	instrs := []instrInfo{
+		{pc: 8, size: 2, kind: fdo.CondTaken, isBranch: true, target: 20, hasTarget: true},
+		{pc: 28, size: 2, kind: fdo.Return, isBranch: true},
+	}
+	bi := map[branchKey]*branchStats{
+		{source: 8, target: 20}: {predicted: 7, missed: 3},
+	}
+
+	edges := functionEdges(blocks, instrs, bi)
+
+	want := map[[2]int]uint64{
+		{0, 1}: 0,  // conditional fall-through edge, no recorded stats
+		{0, 2}: 10, // conditional taken edge, weight from bi
+		{1, 2}: 0,  // plain fall-through, block 1 has no terminating branch
+	}
+	got := make(map[[2]int]uint64, len(edges))
+	for _, e := range edges {
+		got[[2]int{e.from, e.to}] = e.weight
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("functionEdges = %v, want %v", got, want)
+	}
+}
+
+func TestFunctionEdgesCallFallsThrough(t *testing.T) {
+	// A call terminates block 0 at pc 8, but per buildBlocks's doc
+	// comment a call never ends a block; this only exercises the
+	// defensive case where some other leader happens to land right after
+	// one anyway.
+	blocks := []block{
+		{start: 0, end: 10},
+		{start: 10, end: 20},
+	}
+	instrs := []instrInfo{
+		{pc: 8, size: 2, kind: fdo.Call, isBranch: true, target: 1000, hasTarget: true},
+	}
+	edges := functionEdges(blocks, instrs, nil)
+	if len(edges) != 1 || edges[0].from != 0 || edges[0].to != 1 {
+		t.Errorf("functionEdges with a trailing call = %v, want a single fall-through edge 0->1", edges)
+	}
+}
+
+func TestFunctionEdgesIndirectHasNoSuccessor(t *testing.T) {
+	blocks := []block{
+		{start: 0, end: 10},
+		{start: 10, end: 20},
+	}
+	instrs := []instrInfo{
+		{pc: 8, size: 2, kind: fdo.Indirect, isBranch: true},
+	}
+	if edges := functionEdges(blocks, instrs, nil); len(edges) != 0 {
+		t.Errorf("functionEdges with a trailing indirect branch = %v, want no edges", edges)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fdo
+
+import "sort"
+
+// SCOPE NOTE: this file only derives BranchHint values from a profile; it
+// does not wire them into a compiler. That wiring would live in
+// cmd/compile/internal/ssa's layoutOrder plus a new gc -fdoprofile= flag,
+// and cmd/compile does not exist in this tree, so it cannot be built here.
+// `go tool fdo -apply -hints` prints what Hints derives, as a preview of
+// the data a future compiler flag would consume; this is a deliberate,
+// called-out descope of that half of the request, not an oversight.
+
+// BranchHint is a single branch-probability recommendation, in a form
+// consumable directly by the compiler: cmd/compile/internal/ssa's
+// block-ordering pass (layoutOrder) can prefer the hot successor as the
+// fall-through and push the cold successor out-of-line, and the register
+// allocator can bias spill placement toward the cold edge. This is the
+// moral equivalent of GCC's __builtin_expect_with_probability.
+type BranchHint struct {
+	File        string
+	Line        int
+	Func        string
+	Probability float64 // probability that the branch is taken, in [0,1]
+}
+
+// Hints derives compiler-facing BranchHints from the raw counters in p.
+// Only branches whose hit rate lies outside [low, high] are reported: those
+// the predictor mostly gets wrong (below low) and those it mostly gets
+// right (above high). Branches inside the band, bounds included, get no
+// hint.
+func (p *Profile) Hints(low, high float64) []BranchHint {
+	var hints []BranchHint
+	for key, c := range p.Branches {
+		switch key.Kind {
+		case Call, Return, Indirect:
+			continue // No fall-through/taken choice to bias.
+		}
+		total := c.Total()
+		if total == 0 {
+			continue
+		}
+		hit := float64(c.Predicted) / float64(total)
+		if hit >= low && hit <= high {
+			continue // Inside [low, high]: neither threshold crossed.
+		}
+
+		// CondFallthrough records hits against the not-taken outcome;
+		// restate every hint in terms of "probability the branch is
+		// taken" so the compiler doesn't need to know which kind of
+		// edge produced it.
+		probability := hit
+		if key.Kind == CondFallthrough {
+			probability = 1 - hit
+		}
+
+		hints = append(hints, BranchHint{
+			File:        key.File,
+			Line:        key.Line,
+			Func:        key.Func,
+			Probability: probability,
+		})
+	}
+	sort.Slice(hints, func(i, j int) bool {
+		a, b := hints[i], hints[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Func < b.Func
+	})
+	return hints
+}
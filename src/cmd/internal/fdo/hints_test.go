@@ -0,0 +1,64 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fdo
+
+import "testing"
+
+func TestHintsThresholds(t *testing.T) {
+	p := NewProfile()
+	// 90% correct sits exactly on the high threshold, inside the inclusive
+	// [low, high] band: no hint.
+	p.Add(BranchKey{File: "a.go", Line: 1, Func: "pkg.Well", Kind: CondTaken}, 90, 10)
+	// Predicted poorly (5% correct): should surface a low-probability hint.
+	p.Add(BranchKey{File: "a.go", Line: 2, Func: "pkg.Poor", Kind: CondTaken}, 5, 95)
+	// A fall-through edge's hit rate is restated as a taken-probability,
+	// so a poorly predicted one surfaces as a high probability instead.
+	p.Add(BranchKey{File: "a.go", Line: 3, Func: "pkg.Flip", Kind: CondFallthrough}, 5, 95)
+	// Calls, returns, and indirect edges never have a fall-through/taken
+	// choice to bias, regardless of their hit rate.
+	p.Add(BranchKey{File: "a.go", Line: 4, Func: "pkg.Call", Kind: Call}, 0, 100)
+
+	hints := p.Hints(0.10, 0.90)
+
+	byFunc := make(map[string]BranchHint)
+	for _, h := range hints {
+		byFunc[h.Func] = h
+	}
+
+	if _, ok := byFunc["pkg.Well"]; ok {
+		t.Errorf("pkg.Well should not get a hint: its hit rate is inside [low, high]")
+	}
+	if _, ok := byFunc["pkg.Call"]; ok {
+		t.Errorf("pkg.Call should not get a hint: a Call edge has no fall-through/taken choice")
+	}
+
+	poor, ok := byFunc["pkg.Poor"]
+	if !ok {
+		t.Fatalf("pkg.Poor: expected a hint, got none")
+	}
+	if want := 0.05; poor.Probability != want {
+		t.Errorf("pkg.Poor probability = %v, want %v", poor.Probability, want)
+	}
+
+	flip, ok := byFunc["pkg.Flip"]
+	if !ok {
+		t.Fatalf("pkg.Flip: expected a hint, got none")
+	}
+	if want := 0.95; flip.Probability != want {
+		t.Errorf("pkg.Flip probability = %v, want %v (restated as taken-probability)", flip.Probability, want)
+	}
+}
+
+func TestHintsBoundaryInclusive(t *testing.T) {
+	p := NewProfile()
+	p.Add(BranchKey{File: "a.go", Line: 1, Func: "pkg.AtLow", Kind: CondTaken}, 10, 90)
+
+	if hints := p.Hints(0.10, 0.90); len(hints) != 0 {
+		t.Errorf("a branch exactly at the low threshold should not get a hint, got %+v", hints)
+	}
+	if hints := p.Hints(0.11, 0.90); len(hints) != 1 {
+		t.Errorf("a branch just below the low threshold should get a hint, got %+v", hints)
+	}
+}
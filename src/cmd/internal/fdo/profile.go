@@ -0,0 +1,292 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fdo defines the on-disk profile format shared between `go tool
+// fdo` and the compiler. The profile aggregates branch outcomes by source
+// location rather than by raw program counter, so that a profile recorded
+// against one build of a binary remains valid against a later build with a
+// different layout.
+package fdo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profileVersion is the on-disk format version. It must be bumped whenever
+// the format changes in a way that isn't backwards compatible.
+//
+// v2 added the "L" function-layout records alongside the original "B"
+// branch records.
+const profileVersion = 2
+
+// header is the first line of every profile file.
+const header = "go fdo profile v"
+
+// EdgeKind classifies the instruction that originates a branch.
+type EdgeKind int
+
+const (
+	CondTaken EdgeKind = iota
+	CondFallthrough
+	UncondJump
+	Call
+	Return
+	Indirect
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case CondTaken:
+		return "cond-taken"
+	case CondFallthrough:
+		return "cond-fallthrough"
+	case UncondJump:
+		return "jmp"
+	case Call:
+		return "call"
+	case Return:
+		return "ret"
+	case Indirect:
+		return "indirect"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseEdgeKind parses the String form of an EdgeKind.
+func ParseEdgeKind(s string) (EdgeKind, error) {
+	switch s {
+	case "cond-taken":
+		return CondTaken, nil
+	case "cond-fallthrough":
+		return CondFallthrough, nil
+	case "jmp":
+		return UncondJump, nil
+	case "call":
+		return Call, nil
+	case "ret":
+		return Return, nil
+	case "indirect":
+		return Indirect, nil
+	}
+	return 0, fmt.Errorf("fdo: unknown edge kind %q", s)
+}
+
+// BranchKey identifies a branch by source location rather than by address,
+// so that profiles remain meaningful across rebuilds.
+type BranchKey struct {
+	File string
+	Line int
+	Func string
+	Kind EdgeKind
+}
+
+// BranchCounts are the aggregate branch-predictor outcomes for a BranchKey.
+type BranchCounts struct {
+	Predicted uint64
+	Missed    uint64
+}
+
+// Total returns the total number of observed branches.
+func (c BranchCounts) Total() uint64 {
+	return c.Predicted + c.Missed
+}
+
+// FunctionLayout is a whole-function basic-block reordering recommendation,
+// derived from the same LBR edge weights as the BranchKey/BranchCounts
+// above. BlockOrder lists the function's basic blocks, identified by their
+// index in original program order (block 0 is the function entry), in the
+// order the layout pass recommends placing them.
+type FunctionLayout struct {
+	Func       string
+	BlockOrder []int
+}
+
+// Profile is a collection of branch outcomes and layout recommendations
+// keyed by source location. It is the unit of work exchanged between
+// `go tool fdo -extract`, `go tool fdo -merge`, and `go tool fdo -apply`
+// (and, eventually, the compiler's `-fdoprofile` flag).
+type Profile struct {
+	Branches map[BranchKey]BranchCounts
+	Layouts  map[string]FunctionLayout // keyed by FunctionLayout.Func
+}
+
+// NewProfile returns an empty Profile.
+func NewProfile() *Profile {
+	return &Profile{
+		Branches: make(map[BranchKey]BranchCounts),
+		Layouts:  make(map[string]FunctionLayout),
+	}
+}
+
+// Add accumulates predicted/missed counts for key.
+func (p *Profile) Add(key BranchKey, predicted, missed uint64) {
+	c := p.Branches[key]
+	c.Predicted += predicted
+	c.Missed += missed
+	p.Branches[key] = c
+}
+
+// AddLayout records a function layout recommendation, replacing any
+// previous recommendation for the same function.
+func (p *Profile) AddLayout(l FunctionLayout) {
+	p.Layouts[l.Func] = l
+}
+
+// Merge combines profiles into a single Profile, summing branch counts for
+// any BranchKey that appears in more than one of them. Function layouts
+// aren't additive; if more than one profile recommends a layout for the
+// same function, the last one given wins.
+func Merge(profiles ...*Profile) *Profile {
+	out := NewProfile()
+	for _, p := range profiles {
+		for key, c := range p.Branches {
+			out.Add(key, c.Predicted, c.Missed)
+		}
+		for _, l := range p.Layouts {
+			out.AddLayout(l)
+		}
+	}
+	return out
+}
+
+// sortedKeys returns the Branches keys of p in a deterministic order, so
+// that Write produces byte-identical output for equal profiles regardless
+// of map iteration order.
+func (p *Profile) sortedKeys() []BranchKey {
+	keys := make([]BranchKey, 0, len(p.Branches))
+	for key := range p.Branches {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Func != b.Func {
+			return a.Func < b.Func
+		}
+		return a.Kind < b.Kind
+	})
+	return keys
+}
+
+// sortedLayouts returns the Layouts of p in a deterministic order.
+func (p *Profile) sortedLayouts() []FunctionLayout {
+	layouts := make([]FunctionLayout, 0, len(p.Layouts))
+	for _, l := range p.Layouts {
+		layouts = append(layouts, l)
+	}
+	sort.Slice(layouts, func(i, j int) bool { return layouts[i].Func < layouts[j].Func })
+	return layouts
+}
+
+// Write serializes p in the versioned, deterministic fdo profile format.
+func (p *Profile) Write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s%d\n", header, profileVersion); err != nil {
+		return err
+	}
+	for _, key := range p.sortedKeys() {
+		c := p.Branches[key]
+		if _, err := fmt.Fprintf(w, "B\t%s\t%d\t%s\t%s\t%d\t%d\n",
+			key.File, key.Line, key.Func, key.Kind, c.Predicted, c.Missed); err != nil {
+			return err
+		}
+	}
+	for _, l := range p.sortedLayouts() {
+		order := make([]string, len(l.BlockOrder))
+		for i, b := range l.BlockOrder {
+			order[i] = strconv.Itoa(b)
+		}
+		if _, err := fmt.Fprintf(w, "L\t%s\t%s\n", l.Func, strings.Join(order, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read parses a profile previously written by Write.
+func Read(r io.Reader) (*Profile, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("fdo: empty profile")
+	}
+	line := s.Text()
+	if !strings.HasPrefix(line, header) {
+		return nil, fmt.Errorf("fdo: not a profile file")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(line, header))
+	if err != nil {
+		return nil, fmt.Errorf("fdo: malformed profile version: %v", err)
+	}
+	if version != profileVersion {
+		return nil, fmt.Errorf("fdo: unsupported profile version %d (want %d)", version, profileVersion)
+	}
+
+	p := NewProfile()
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		switch parts[0] {
+		case "B":
+			if len(parts) != 7 {
+				return nil, fmt.Errorf("fdo: malformed branch record %q", line)
+			}
+			lineno, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("fdo: malformed line number in %q: %v", line, err)
+			}
+			kind, err := ParseEdgeKind(parts[4])
+			if err != nil {
+				return nil, fmt.Errorf("fdo: %v", err)
+			}
+			predicted, err := strconv.ParseUint(parts[5], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fdo: malformed predicted count in %q: %v", line, err)
+			}
+			missed, err := strconv.ParseUint(parts[6], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fdo: malformed missed count in %q: %v", line, err)
+			}
+			key := BranchKey{File: parts[1], Line: lineno, Func: parts[3], Kind: kind}
+			p.Add(key, predicted, missed)
+		case "L":
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("fdo: malformed layout record %q", line)
+			}
+			var order []int
+			if parts[2] != "" {
+				for _, s := range strings.Split(parts[2], ",") {
+					n, err := strconv.Atoi(s)
+					if err != nil {
+						return nil, fmt.Errorf("fdo: malformed block index in %q: %v", line, err)
+					}
+					order = append(order, n)
+				}
+			}
+			p.AddLayout(FunctionLayout{Func: parts[1], BlockOrder: order})
+		default:
+			return nil, fmt.Errorf("fdo: unknown record kind in %q", line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fdo
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestProfileWriteRead(t *testing.T) {
+	want := NewProfile()
+	want.Add(BranchKey{File: "a.go", Line: 10, Func: "pkg.A", Kind: CondTaken}, 7, 3)
+	want.Add(BranchKey{File: "a.go", Line: 10, Func: "pkg.A", Kind: CondTaken}, 1, 0)
+	want.Add(BranchKey{File: "b.go", Line: 5, Func: "pkg.B", Kind: UncondJump}, 4, 0)
+	want.AddLayout(FunctionLayout{Func: "pkg.A", BlockOrder: []int{0, 2, 1}})
+	want.AddLayout(FunctionLayout{Func: "pkg.B", BlockOrder: nil})
+
+	var buf bytes.Buffer
+	if err := want.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestProfileWriteDeterministic(t *testing.T) {
+	p := NewProfile()
+	p.Add(BranchKey{File: "b.go", Line: 1, Func: "pkg.B", Kind: UncondJump}, 1, 0)
+	p.Add(BranchKey{File: "a.go", Line: 2, Func: "pkg.A", Kind: CondTaken}, 1, 0)
+	p.AddLayout(FunctionLayout{Func: "pkg.B", BlockOrder: []int{1, 0}})
+	p.AddLayout(FunctionLayout{Func: "pkg.A", BlockOrder: []int{0, 1}})
+
+	var first, second bytes.Buffer
+	if err := p.Write(&first); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := p.Write(&second); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("Write is not deterministic across calls:\n%q\n%q", first.String(), second.String())
+	}
+}
+
+func TestReadRejectsWrongVersion(t *testing.T) {
+	_, err := Read(bytes.NewBufferString("go fdo profile v1\n"))
+	if err == nil {
+		t.Fatal("Read accepted a profile with the wrong version")
+	}
+}
+
+func TestReadRejectsUnknownRecordKind(t *testing.T) {
+	_, err := Read(bytes.NewBufferString("go fdo profile v2\nX\tbogus\n"))
+	if err == nil {
+		t.Fatal("Read accepted an unknown record kind")
+	}
+}
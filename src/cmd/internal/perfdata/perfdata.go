@@ -0,0 +1,496 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package perfdata reads the Linux "perf.data" file format directly,
+// without shelling out to the perf tool. Only what `go tool fdo` needs is
+// implemented: the file header, enough of perf_event_attr to know how a
+// sample record is laid out, PERF_RECORD_MMAP/MMAP2 (so PC ranges can be
+// attributed to the binaries that were mapped), and PERF_RECORD_SAMPLE
+// records carrying a PERF_SAMPLE_BRANCH_STACK payload.
+//
+// See the perf_event_open(2) man page for the on-disk record layouts this
+// package decodes.
+package perfdata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Record types from linux/perf_event.h. Only the ones this package
+// understands are listed; anything else is skipped using its header size.
+const (
+	recordMmap   = 1
+	recordLost   = 2
+	recordComm   = 3
+	recordExit   = 4
+	recordSample = 9
+	recordMmap2  = 10
+)
+
+// Sample fields from linux/perf_event.h, in the order they appear (when
+// present) in a PERF_RECORD_SAMPLE payload.
+const (
+	sampleIP          = 1 << 0
+	sampleTID         = 1 << 1
+	sampleTime        = 1 << 2
+	sampleAddr        = 1 << 3
+	sampleRead        = 1 << 4
+	sampleCallchain   = 1 << 5
+	sampleID          = 1 << 6
+	sampleCPU         = 1 << 7
+	samplePeriod      = 1 << 8
+	sampleStreamID    = 1 << 9
+	sampleRaw         = 1 << 10
+	sampleBranchStack = 1 << 11
+)
+
+// Read-format flags from linux/perf_event.h, used to size the optional
+// PERF_SAMPLE_READ payload that can precede PERF_SAMPLE_BRANCH_STACK.
+const (
+	formatTotalTimeEnabled = 1 << 0
+	formatTotalTimeRunning = 1 << 1
+	formatID               = 1 << 2
+	formatGroup            = 1 << 3
+)
+
+// fileSection locates a region of the file.
+type fileSection struct {
+	Offset uint64
+	Size   uint64
+}
+
+// fileHeader is the "PERFILE2" perf.data header.
+type fileHeader struct {
+	Magic      [8]byte
+	Size       uint64
+	AttrSize   uint64
+	Attrs      fileSection
+	Data       fileSection
+	EventTypes fileSection
+	Flags      uint64
+	Flags1     [3]uint64
+}
+
+var magicV2 = [8]byte{'P', 'E', 'R', 'F', 'I', 'L', 'E', '2'}
+
+// eventAttr holds the handful of perf_event_attr fields we need. We don't
+// model the whole (versioned, kernel-dependent) struct; sample_type and
+// read_format sit at fixed offsets in every ABI version this package has
+// to deal with, which is all that's required to walk a sample record.
+type eventAttr struct {
+	sampleType uint64
+	readFormat uint64
+}
+
+func parseEventAttr(b []byte) (eventAttr, error) {
+	if len(b) < 40 {
+		return eventAttr{}, fmt.Errorf("perfdata: truncated perf_event_attr (%d bytes)", len(b))
+	}
+	return eventAttr{
+		sampleType: binary.LittleEndian.Uint64(b[24:32]),
+		readFormat: binary.LittleEndian.Uint64(b[32:40]),
+	}, nil
+}
+
+// Mapping records a PERF_RECORD_MMAP/MMAP2 region: a [Start, Start+Len)
+// range of the sampled process's address space backed by Filename,
+// starting at file offset PgOff within it.
+type Mapping struct {
+	Pid, Tid uint32
+	Start    uint64
+	Len      uint64
+	PgOff    uint64
+	Filename string
+}
+
+// Reader parses a perf.data file.
+type Reader struct {
+	f     *os.File
+	hdr   fileHeader
+	attrs []eventAttr
+
+	// mappings is populated lazily, the first time Mappings or Branches
+	// walks the data section.
+	mappings []Mapping
+}
+
+// Open opens the perf.data file at name.
+func Open(name string) (*Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f}
+	if err := r.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := r.readAttrs(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the underlying file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+func (r *Reader) readHeader() error {
+	if err := binary.Read(io.NewSectionReader(r.f, 0, 1<<20), binary.LittleEndian, &r.hdr); err != nil {
+		return fmt.Errorf("perfdata: reading header: %v", err)
+	}
+	if r.hdr.Magic != magicV2 {
+		return fmt.Errorf("perfdata: unsupported file magic %q (only PERFILE2 is supported)", r.hdr.Magic)
+	}
+	return nil
+}
+
+// readAttrs reads the perf_event_attr array out of the attrs section. Each
+// entry is header.AttrSize bytes of perf_event_attr followed by a 16-byte
+// perf_file_section describing where that event's ids live; we only care
+// about the attr bytes themselves.
+func (r *Reader) readAttrs() error {
+	if r.hdr.AttrSize == 0 {
+		return fmt.Errorf("perfdata: zero attr_size in header")
+	}
+	stride := r.hdr.AttrSize + 16 // attr + trailing perf_file_section of ids
+	n := r.hdr.Attrs.Size / stride
+	sr := io.NewSectionReader(r.f, int64(r.hdr.Attrs.Offset), int64(r.hdr.Attrs.Size))
+	buf := make([]byte, r.hdr.AttrSize)
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(sr, buf); err != nil {
+			return fmt.Errorf("perfdata: reading attr %d: %v", i, err)
+		}
+		attr, err := parseEventAttr(buf)
+		if err != nil {
+			return err
+		}
+		r.attrs = append(r.attrs, attr)
+		if _, err := sr.Seek(16, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	if len(r.attrs) == 0 {
+		return fmt.Errorf("perfdata: no event attrs found")
+	}
+	return nil
+}
+
+// readFormatSize returns the size in bytes of the PERF_SAMPLE_READ payload
+// for the given attr, so it can be skipped without being interpreted.
+func readFormatSize(attr eventAttr) int {
+	size := 8 // value, or nr if PERF_FORMAT_GROUP
+	if attr.readFormat&formatTotalTimeEnabled != 0 {
+		size += 8
+	}
+	if attr.readFormat&formatTotalTimeRunning != 0 {
+		size += 8
+	}
+	if attr.readFormat&formatGroup == 0 {
+		if attr.readFormat&formatID != 0 {
+			size += 8
+		}
+		return size
+	}
+	// The grouped form can't be sized without knowing nr, which lives in
+	// the payload itself; the caller reads it dynamically instead.
+	return -1
+}
+
+// Mappings returns every PERF_RECORD_MMAP/MMAP2 region observed in the
+// file, walking the data section if it hasn't been walked yet.
+func (r *Reader) Mappings() ([]Mapping, error) {
+	if r.mappings == nil {
+		if err := r.walk(nil); err != nil {
+			return nil, err
+		}
+	}
+	return r.mappings, nil
+}
+
+// Branches iterates over every LBR (last-branch-record) entry recorded in
+// PERF_RECORD_SAMPLE payloads, calling fn for each one. It is the
+// in-process equivalent of `perf script -F brstack`, used in place of
+// runPerfScript's regex scraping.
+func (r *Reader) Branches(fn func(from, to uint64, predicted, mispred bool, cycles uint16)) error {
+	return r.walk(fn)
+}
+
+// walk reads every record in the data section once, collecting mappings
+// and (if branchFn is non-nil) invoking branchFn for every LBR entry in
+// every sample.
+func (r *Reader) walk(branchFn func(from, to uint64, predicted, mispred bool, cycles uint16)) error {
+	sr := io.NewSectionReader(r.f, int64(r.hdr.Data.Offset), int64(r.hdr.Data.Size))
+	var hdrBuf [8]byte
+	var mappings []Mapping
+	for {
+		if _, err := io.ReadFull(sr, hdrBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("perfdata: reading record header: %v", err)
+		}
+		typ := binary.LittleEndian.Uint32(hdrBuf[0:4])
+		size := binary.LittleEndian.Uint16(hdrBuf[6:8])
+		if size < 8 {
+			return fmt.Errorf("perfdata: malformed record (size %d)", size)
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(sr, body); err != nil {
+			return fmt.Errorf("perfdata: reading record body: %v", err)
+		}
+
+		switch typ {
+		case recordMmap:
+			if m, ok := parseMmap(body); ok {
+				mappings = append(mappings, m)
+			}
+		case recordMmap2:
+			if m, ok := parseMmap2(body); ok {
+				mappings = append(mappings, m)
+			}
+		case recordSample:
+			if branchFn != nil {
+				if err := parseSampleBranches(body, r.attrs[0], branchFn); err != nil {
+					return err
+				}
+			}
+		}
+		// Other record types (LOST, COMM, EXIT, THROTTLE, FORK, READ,
+		// ...) carry nothing we need; we've already consumed their
+		// bytes above via size, so there's nothing further to do.
+	}
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Start < mappings[j].Start })
+	r.mappings = mappings
+	return nil
+}
+
+// parseMmap decodes a PERF_RECORD_MMAP body:
+//
+//	u32 pid, tid
+//	u64 addr
+//	u64 len
+//	u64 pgoff
+//	char filename[]
+func parseMmap(b []byte) (Mapping, bool) {
+	if len(b) < 32 {
+		return Mapping{}, false
+	}
+	m := Mapping{
+		Pid:      binary.LittleEndian.Uint32(b[0:4]),
+		Tid:      binary.LittleEndian.Uint32(b[4:8]),
+		Start:    binary.LittleEndian.Uint64(b[8:16]),
+		Len:      binary.LittleEndian.Uint64(b[16:24]),
+		PgOff:    binary.LittleEndian.Uint64(b[24:32]),
+		Filename: cString(b[32:]),
+	}
+	return m, true
+}
+
+// parseMmap2 decodes a PERF_RECORD_MMAP2 body, which adds file
+// identification fields (maj/min/ino/ino_generation) and a prot/flags
+// pair between pgoff and the filename; we only need the fields MMAP also
+// has.
+//
+//	u32 pid, tid
+//	u64 addr
+//	u64 len
+//	u64 pgoff
+//	u32 maj, min
+//	u64 ino
+//	u64 ino_generation
+//	u32 prot, flags
+//	char filename[]
+func parseMmap2(b []byte) (Mapping, bool) {
+	const fixed = 4 + 4 + 8 + 8 + 8 + 4 + 4 + 8 + 8 + 4 + 4
+	if len(b) < fixed {
+		return Mapping{}, false
+	}
+	m := Mapping{
+		Pid:      binary.LittleEndian.Uint32(b[0:4]),
+		Tid:      binary.LittleEndian.Uint32(b[4:8]),
+		Start:    binary.LittleEndian.Uint64(b[8:16]),
+		Len:      binary.LittleEndian.Uint64(b[16:24]),
+		PgOff:    binary.LittleEndian.Uint64(b[24:32]),
+		Filename: cString(b[fixed:]),
+	}
+	return m, true
+}
+
+// cString returns the leading NUL-terminated string in b.
+func cString(b []byte) string {
+	if i := indexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, x := range b {
+		if x == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseSampleBranches walks the optional fields of a PERF_RECORD_SAMPLE
+// payload, in the fixed order mandated by perf_event_open(2), stopping as
+// soon as it has read the PERF_SAMPLE_BRANCH_STACK entries (or determined
+// that sample_type doesn't include them).
+func parseSampleBranches(b []byte, attr eventAttr, fn func(from, to uint64, predicted, mispred bool, cycles uint16)) error {
+	st := attr.sampleType
+	if st&sampleBranchStack == 0 {
+		return nil // This event wasn't recorded with -b.
+	}
+
+	off := 0
+	need := func(n int) bool { return n >= 0 && off+n <= len(b) }
+	// needCount reports whether n elements of size bytes each fit in the
+	// bytes remaining after off. n is read straight off the wire and can
+	// be anything up to 1<<64-1, so the bound is checked as a division
+	// rather than by computing n*size, which would overflow int (or even
+	// uint64, for a large enough n) and wrap around to a small value that
+	// passes a naively multiplied bounds check.
+	needCount := func(n uint64, size int) bool {
+		return n <= uint64(len(b)-off)/uint64(size)
+	}
+
+	if st&sampleIP != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (ip)")
+		}
+		off += 8
+	}
+	if st&sampleTID != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (tid)")
+		}
+		off += 8
+	}
+	if st&sampleTime != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (time)")
+		}
+		off += 8
+	}
+	if st&sampleAddr != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (addr)")
+		}
+		off += 8
+	}
+	if st&sampleID != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (id)")
+		}
+		off += 8
+	}
+	if st&sampleStreamID != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (stream_id)")
+		}
+		off += 8
+	}
+	if st&sampleCPU != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (cpu/res)")
+		}
+		off += 8
+	}
+	if st&samplePeriod != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (period)")
+		}
+		off += 8
+	}
+	if st&sampleRead != 0 {
+		n := readFormatSize(attr)
+		if n < 0 {
+			// PERF_FORMAT_GROUP: the leading nr, followed by the
+			// optional time fields, tells us how much more to skip.
+			if !need(8) {
+				return fmt.Errorf("perfdata: truncated sample (read nr)")
+			}
+			nr := binary.LittleEndian.Uint64(b[off:])
+			off += 8
+			times := 0
+			if attr.readFormat&formatTotalTimeEnabled != 0 {
+				times += 8
+			}
+			if attr.readFormat&formatTotalTimeRunning != 0 {
+				times += 8
+			}
+			if !need(times) {
+				return fmt.Errorf("perfdata: truncated sample (read times)")
+			}
+			off += times
+			entry := 8
+			if attr.readFormat&formatID != 0 {
+				entry += 8
+			}
+			if !needCount(nr, entry) {
+				return fmt.Errorf("perfdata: truncated sample (read group)")
+			}
+			n = int(nr) * entry
+		}
+		if !need(n) {
+			return fmt.Errorf("perfdata: truncated sample (read)")
+		}
+		off += n
+	}
+	if st&sampleCallchain != 0 {
+		if !need(8) {
+			return fmt.Errorf("perfdata: truncated sample (callchain nr)")
+		}
+		nr := binary.LittleEndian.Uint64(b[off:])
+		off += 8
+		if !needCount(nr, 8) {
+			return fmt.Errorf("perfdata: truncated sample (callchain)")
+		}
+		off += int(nr) * 8
+	}
+	if st&sampleRaw != 0 {
+		if !need(4) {
+			return fmt.Errorf("perfdata: truncated sample (raw size)")
+		}
+		n := int(binary.LittleEndian.Uint32(b[off:]))
+		off += 4
+		if !need(n) {
+			return fmt.Errorf("perfdata: truncated sample (raw)")
+		}
+		off += n
+	}
+
+	// We're now positioned at the branch stack: a u64 count followed by
+	// that many 24-byte perf_branch_entry records.
+	if !need(8) {
+		return fmt.Errorf("perfdata: truncated sample (branch_stack nr)")
+	}
+	bnr := binary.LittleEndian.Uint64(b[off:])
+	off += 8
+	const entrySize = 24
+	if !needCount(bnr, entrySize) {
+		return fmt.Errorf("perfdata: truncated sample (branch_stack entries)")
+	}
+	for i := uint64(0); i < bnr; i++ {
+		e := b[off : off+entrySize]
+		from := binary.LittleEndian.Uint64(e[0:8])
+		to := binary.LittleEndian.Uint64(e[8:16])
+		flags := binary.LittleEndian.Uint64(e[16:24])
+		mispred := flags&0x1 != 0
+		predicted := flags&0x2 != 0
+		cycles := uint16((flags >> 4) & 0xffff)
+		fn(from, to, predicted, mispred, cycles)
+		off += entrySize
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfdata
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// putU64 appends v to b in the little-endian order every field in this
+// package uses.
+func putU64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+func TestParseMmap(t *testing.T) {
+	var b []byte
+	b = append(b, 0, 0, 0, 0) // pid
+	b = append(b, 0, 0, 0, 0) // tid
+	b = putU64(b, 0x400000)   // addr
+	b = putU64(b, 0x1000)     // len
+	b = putU64(b, 0)          // pgoff
+	b = append(b, "a.out\x00"...)
+
+	m, ok := parseMmap(b)
+	if !ok {
+		t.Fatalf("parseMmap failed on well-formed input")
+	}
+	if m.Start != 0x400000 || m.Len != 0x1000 || m.PgOff != 0 || m.Filename != "a.out" {
+		t.Errorf("parseMmap = %+v, want {Start:0x400000 Len:0x1000 PgOff:0 Filename:a.out}", m)
+	}
+
+	if _, ok := parseMmap(b[:31]); ok {
+		t.Errorf("parseMmap accepted a truncated record")
+	}
+}
+
+func TestParseMmap2(t *testing.T) {
+	var b []byte
+	b = append(b, 0, 0, 0, 0) // pid
+	b = append(b, 0, 0, 0, 0) // tid
+	b = putU64(b, 0x7f0000)   // addr
+	b = putU64(b, 0x2000)     // len
+	b = putU64(b, 0x1000)     // pgoff
+	b = append(b, 0, 0, 0, 0) // maj
+	b = append(b, 0, 0, 0, 0) // min
+	b = putU64(b, 0)          // ino
+	b = putU64(b, 0)          // ino_generation
+	b = append(b, 0, 0, 0, 0) // prot
+	b = append(b, 0, 0, 0, 0) // flags
+	b = append(b, "libc.so\x00"...)
+
+	m, ok := parseMmap2(b)
+	if !ok {
+		t.Fatalf("parseMmap2 failed on well-formed input")
+	}
+	if m.Start != 0x7f0000 || m.Len != 0x2000 || m.PgOff != 0x1000 || m.Filename != "libc.so" {
+		t.Errorf("parseMmap2 = %+v, want {Start:0x7f0000 Len:0x2000 PgOff:0x1000 Filename:libc.so}", m)
+	}
+
+	if _, ok := parseMmap2(b[:63]); ok {
+		t.Errorf("parseMmap2 accepted a truncated record")
+	}
+}
+
+func TestCString(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte("hello\x00garbage"), "hello"},
+		{[]byte("no-nul"), "no-nul"},
+		{[]byte{}, ""},
+	}
+	for _, c := range cases {
+		if got := cString(c.in); got != c.want {
+			t.Errorf("cString(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadFormatSize(t *testing.T) {
+	cases := []struct {
+		readFormat uint64
+		want       int
+	}{
+		{0, 8},
+		{formatTotalTimeEnabled, 16},
+		{formatTotalTimeEnabled | formatTotalTimeRunning, 24},
+		{formatID, 16},
+		{formatGroup, -1},
+	}
+	for _, c := range cases {
+		if got := readFormatSize(eventAttr{readFormat: c.readFormat}); got != c.want {
+			t.Errorf("readFormatSize(%#x) = %d, want %d", c.readFormat, got, c.want)
+		}
+	}
+}
+
+// branchEntry appends a single 24-byte perf_branch_entry to b.
+func branchEntry(b []byte, from, to uint64, predicted, mispred bool, cycles uint16) []byte {
+	b = putU64(b, from)
+	b = putU64(b, to)
+	var flags uint64
+	if mispred {
+		flags |= 0x1
+	}
+	if predicted {
+		flags |= 0x2
+	}
+	flags |= uint64(cycles) << 4
+	return putU64(b, flags)
+}
+
+func TestParseSampleBranches(t *testing.T) {
+	attr := eventAttr{sampleType: sampleBranchStack}
+
+	var b []byte
+	b = putU64(b, 2) // branch_stack nr
+	b = branchEntry(b, 0x1000, 0x2000, true, false, 3)
+	b = branchEntry(b, 0x3000, 0x4000, false, true, 7)
+
+	var got [][2]uint64
+	err := parseSampleBranches(b, attr, func(from, to uint64, predicted, mispred bool, cycles uint16) {
+		got = append(got, [2]uint64{from, to})
+		if from == 0x1000 && (!predicted || mispred || cycles != 3) {
+			t.Errorf("entry 0: predicted=%v mispred=%v cycles=%d, want true false 3", predicted, mispred, cycles)
+		}
+		if from == 0x3000 && (predicted || !mispred || cycles != 7) {
+			t.Errorf("entry 1: predicted=%v mispred=%v cycles=%d, want false true 7", predicted, mispred, cycles)
+		}
+	})
+	if err != nil {
+		t.Fatalf("parseSampleBranches: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("parseSampleBranches called fn %d times, want 2", len(got))
+	}
+}
+
+func TestParseSampleBranchesNoBranchStack(t *testing.T) {
+	attr := eventAttr{sampleType: sampleIP}
+	called := false
+	if err := parseSampleBranches([]byte{}, attr, func(uint64, uint64, bool, bool, uint16) {
+		called = true
+	}); err != nil {
+		t.Fatalf("parseSampleBranches: %v", err)
+	}
+	if called {
+		t.Errorf("fn was called for a sample without PERF_SAMPLE_BRANCH_STACK")
+	}
+}
+
+func TestParseSampleBranchesTruncated(t *testing.T) {
+	attr := eventAttr{sampleType: sampleBranchStack}
+	var b []byte
+	b = putU64(b, 2) // claims 2 entries
+	b = branchEntry(b, 0x1000, 0x2000, true, false, 0)
+	// ... but only one is actually present.
+
+	if err := parseSampleBranches(b, attr, func(uint64, uint64, bool, bool, uint16) {}); err == nil {
+		t.Errorf("parseSampleBranches accepted a branch_stack nr bigger than the data present")
+	}
+}
+
+// TestParseSampleBranchesOverflow is a regression test: bnr used to be
+// bounds-checked as int(bnr)*entrySize, which overflows for a large enough
+// bnr and wraps back under the length check, leading to a slice-bounds
+// panic a few lines later instead of the error this expects.
+func TestParseSampleBranchesOverflow(t *testing.T) {
+	attr := eventAttr{sampleType: sampleBranchStack}
+	b := putU64(nil, 1<<62) // branch_stack nr: absurdly large, no entries follow
+
+	err := parseSampleBranches(b, attr, func(uint64, uint64, bool, bool, uint16) {
+		t.Errorf("fn should not be called when branch_stack nr is bogus")
+	})
+	if err == nil {
+		t.Fatalf("parseSampleBranches(bnr=1<<62) = nil error, want an error")
+	}
+}
+
+func TestParseSampleBranchesSkipsLeadingFields(t *testing.T) {
+	// sampleIP, sampleCallchain, and sampleBranchStack all present: the
+	// callchain nr/entries must be skipped before the branch stack is read.
+	attr := eventAttr{sampleType: sampleIP | sampleCallchain | sampleBranchStack}
+
+	var b []byte
+	b = putU64(b, 0x401000) // ip
+	b = putU64(b, 2)        // callchain nr
+	b = putU64(b, 0xaaaa)   // callchain[0]
+	b = putU64(b, 0xbbbb)   // callchain[1]
+	b = putU64(b, 1)        // branch_stack nr
+	b = branchEntry(b, 0x5000, 0x6000, true, false, 1)
+
+	var from, to uint64
+	err := parseSampleBranches(b, attr, func(f, target uint64, predicted, mispred bool, cycles uint16) {
+		from, to = f, target
+	})
+	if err != nil {
+		t.Fatalf("parseSampleBranches: %v", err)
+	}
+	if from != 0x5000 || to != 0x6000 {
+		t.Errorf("parseSampleBranches read from/to = %#x/%#x, want 0x5000/0x6000 (callchain not skipped correctly)", from, to)
+	}
+}
+
+// TestParseSampleBranchesCallchainOverflow exercises the same overflow fix
+// for the callchain nr, which is bounds-checked before the branch stack nr
+// is even reached.
+func TestParseSampleBranchesCallchainOverflow(t *testing.T) {
+	attr := eventAttr{sampleType: sampleCallchain | sampleBranchStack}
+	b := putU64(nil, 1<<62) // callchain nr: absurdly large, no entries follow
+
+	if err := parseSampleBranches(b, attr, func(uint64, uint64, bool, bool, uint16) {}); err == nil {
+		t.Fatalf("parseSampleBranches(callchain nr=1<<62) = nil error, want an error")
+	}
+}